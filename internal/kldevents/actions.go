@@ -15,21 +15,16 @@
 package kldevents
 
 import (
-	"bytes"
-	"container/list"
 	"context"
-	"crypto/tls"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net"
-	"net/http"
 	"net/url"
 	"strings"
 	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+
+	"github.com/kaleido-io/ethconnect/internal/kldevents/wsevents"
 )
 
 const (
@@ -39,21 +34,26 @@ const (
 	ErrorHandlingSkip = "skip"
 	// MaxBatchSize is the maximum that a user can specific for their batch size
 	MaxBatchSize = 1000
-	// DefaultExponentialBackoffInitial  is the initial delay for backoff retry
-	DefaultExponentialBackoffInitial = time.Duration(1) * time.Second
-	// DefaultExponentialBackoffFactor is the factor we use between retries
-	DefaultExponentialBackoffFactor = float64(2.0)
+	// ActionTypeWebhook delivers batches via an outbound HTTP POST to a configured URL
+	ActionTypeWebhook = "webhook"
+	// ActionTypeWebSocket delivers batches to subscribers of a WebSocket topic
+	ActionTypeWebSocket = "websocket"
 )
 
 // actionSpec configures the action to perform for each event
 type actionSpec struct {
-	Type                 string         `json:"type,omitempty"`
-	BatchSize            uint64         `json:"batchSize,omitempty"`
-	BatchTimeoutMS       uint64         `json:"batchTimeoutMS,omitempty"`
-	ErrorHandling        string         `json:"errorHandling,omitempty"`
-	RetryTimeoutSec      uint64         `json:"retryTimeoutSec,omitempty"`
-	BlockedRetryDelaySec uint64         `json:"blockedReryDelaySec,omitempty"`
-	Webhook              *webhookAction `json:"webhook,omitempty"`
+	Type                 string           `json:"type,omitempty"`
+	BatchSize            uint64           `json:"batchSize,omitempty"`
+	BatchTimeoutMS       uint64           `json:"batchTimeoutMS,omitempty"`
+	ErrorHandling        string           `json:"errorHandling,omitempty"`
+	RetryTimeoutSec      uint64           `json:"retryTimeoutSec,omitempty"`
+	BlockedRetryDelaySec uint64           `json:"blockedReryDelaySec,omitempty"`
+	Concurrency          uint64           `json:"concurrency,omitempty"`
+	Retry                *retrySpec       `json:"retry,omitempty"`
+	CircuitBreaker       *circuitBreaker  `json:"circuitBreaker,omitempty"`
+	DeadLetter           *deadLetterSpec  `json:"deadLetter,omitempty"`
+	Webhook              *webhookAction   `json:"webhook,omitempty"`
+	WebSocket            *webSocketAction `json:"websocket,omitempty"`
 }
 
 type webhookAction struct {
@@ -61,22 +61,51 @@ type webhookAction struct {
 	Headers           map[string]string `json:"headers,omitempty"`
 	TLSkipHostVerify  bool              `json:"tlsSkipHostVerify,omitempty"`
 	RequestTimeoutSec uint32            `json:"requestTimeoutSec,omitempty"`
+	MaxRequestBytes   uint64            `json:"maxRequestBytes,omitempty"`
+	MaxResponseBytes  uint64            `json:"maxResponseBytes,omitempty"`
+}
+
+// webSocketAction configures delivery of batches to subscribers of a WebSocket topic
+type webSocketAction struct {
+	Topic            string `json:"topic,omitempty"`
+	DistributionMode string `json:"distributionMode,omitempty"`
 }
 
 type action struct {
-	id                string
-	allowPrivateIPs   bool
-	spec              *actionSpec
-	eventStream       chan *eventData
-	stopped           bool
-	dispatcherDone    bool
-	processorDone     bool
-	inFlight          uint64
-	batchCond         *sync.Cond
-	batchQueue        *list.List
-	batchCount        uint64
-	initialRetryDelay time.Duration
-	backoffFactor     float64
+	id              string
+	allowPrivateIPs bool
+	spec            *actionSpec
+	eventStream     chan *eventData
+	stopped         bool
+	dispatcherDone  bool
+	inFlight        uint64
+	batchCond       *sync.Cond
+	batchCount      uint64
+	pool            *dispatcherPool
+	ctx             context.Context
+	cancel          context.CancelFunc
+
+	consecutiveFailures uint64
+	suspended           bool
+}
+
+// wsRegistry is the process-wide registry of WebSocket connections attached
+// to event stream topics, shared by every action of type 'websocket'
+var wsRegistry = wsevents.NewRegistry()
+
+// sharedDispatcherPool is the process-wide pool of worker goroutines that run
+// every action's batches. EventStreamPoolSize can be raised at startup, before
+// any actions are created, if the default is too small for the deployment.
+var sharedDispatcherPool = newDispatcherPool(DefaultEventStreamPoolSize)
+
+// EventStreamPoolSize configures the number of worker goroutines shared across
+// all event stream actions. It replaces the shared pool, stopping the workers
+// of whichever pool it is replacing, so it must only be called during startup
+// before any subscriptions have been created.
+func EventStreamPoolSize(size int) {
+	old := sharedDispatcherPool
+	sharedDispatcherPool = newDispatcherPool(size)
+	old.stop()
 }
 
 // newAction constructor verfies the action is correct, kicks
@@ -97,10 +126,18 @@ func newAction(id string, allowPrivateIPs bool, spec *actionSpec) (a *action, er
 	if spec.BlockedRetryDelaySec == 0 {
 		spec.BlockedRetryDelaySec = 30
 	}
+	if spec.Concurrency == 0 {
+		spec.Concurrency = DefaultConcurrency
+	}
+	retryExplicit := spec.Retry != nil
+	if spec.Retry == nil {
+		spec.Retry = &retrySpec{}
+	}
+	spec.Retry.setDefaults(spec.RetryTimeoutSec, retryExplicit)
 
 	spec.Type = strings.ToLower(spec.Type)
 	switch spec.Type {
-	case "webhook":
+	case ActionTypeWebhook:
 		if spec.Webhook == nil || spec.Webhook.URL == "" {
 			return nil, fmt.Errorf("Must specify webhook.url for action type 'webhook'")
 		}
@@ -110,38 +147,79 @@ func newAction(id string, allowPrivateIPs bool, spec *actionSpec) (a *action, er
 		if spec.Webhook.RequestTimeoutSec == 0 {
 			spec.Webhook.RequestTimeoutSec = 30000
 		}
+		if spec.Webhook.MaxRequestBytes == 0 {
+			spec.Webhook.MaxRequestBytes = DefaultMaxRequestBytes
+		}
+		if spec.Webhook.MaxResponseBytes == 0 {
+			spec.Webhook.MaxResponseBytes = DefaultMaxResponseBytes
+		}
+	case ActionTypeWebSocket:
+		if spec.WebSocket == nil || spec.WebSocket.Topic == "" {
+			return nil, fmt.Errorf("Must specify websocket.topic for action type 'websocket'")
+		}
+		spec.WebSocket.DistributionMode = strings.ToLower(spec.WebSocket.DistributionMode)
+		switch spec.WebSocket.DistributionMode {
+		case wsevents.DistributionModeBroadcast:
+		case "":
+			spec.WebSocket.DistributionMode = wsevents.DistributionModeLoadBalance
+		case wsevents.DistributionModeLoadBalance:
+		default:
+			return nil, fmt.Errorf("Invalid distributionMode '%s' for websocket action", spec.WebSocket.DistributionMode)
+		}
 	default:
 		return nil, fmt.Errorf("Unknown action type '%s'", spec.Type)
 	}
 
-	if strings.ToLower(spec.ErrorHandling) == ErrorHandlingBlock {
+	switch strings.ToLower(spec.ErrorHandling) {
+	case ErrorHandlingBlock:
 		spec.ErrorHandling = ErrorHandlingBlock
-	} else {
+	case ErrorHandlingDeadLetter:
+		if spec.DeadLetter == nil || (spec.DeadLetter.Webhook == nil && spec.DeadLetter.FilePath == "") {
+			return nil, fmt.Errorf("Must specify deadLetter.webhook or deadLetter.filePath for errorHandling 'deadletter'")
+		}
+		spec.ErrorHandling = ErrorHandlingDeadLetter
+	default:
 		spec.ErrorHandling = ErrorHandlingSkip
 	}
+	if spec.CircuitBreaker != nil {
+		if spec.DeadLetter == nil || (spec.DeadLetter.Webhook == nil && spec.DeadLetter.FilePath == "") {
+			return nil, fmt.Errorf("Must specify deadLetter.webhook or deadLetter.filePath when circuitBreaker is configured")
+		}
+		if spec.CircuitBreaker.FailureThreshold == 0 {
+			spec.CircuitBreaker.FailureThreshold = DefaultBreakerThreshold
+		}
+	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	a = &action{
-		id:                id,
-		spec:              spec,
-		allowPrivateIPs:   allowPrivateIPs,
-		eventStream:       make(chan *eventData),
-		batchCond:         sync.NewCond(&sync.Mutex{}),
-		batchQueue:        list.New(),
-		initialRetryDelay: DefaultExponentialBackoffInitial,
-		backoffFactor:     DefaultExponentialBackoffFactor,
+		id:              id,
+		spec:            spec,
+		allowPrivateIPs: allowPrivateIPs,
+		eventStream:     make(chan *eventData),
+		batchCond:       sync.NewCond(&sync.Mutex{}),
+		pool:            sharedDispatcherPool,
+		ctx:             ctx,
+		cancel:          cancel,
 	}
-	go a.batchProcessor()
+	a.pool.setLimit(a.id, spec.Concurrency)
+	registerAction(a)
 	go a.batchDispatcher()
 	return a, nil
 }
 
-// stop is a lazy stop, that marks a flag for the batch goroutine to pick up
+// stop is a lazy stop, that marks a flag for the batch goroutine to pick up,
+// cancels any of this action's batches still queued (but not yet running) in
+// the shared dispatcher pool, and interrupts a retry sleep in progress so
+// in-flight batches don't wait out their current backoff before noticing
 func (a *action) stop() {
 	a.batchCond.L.Lock()
 	a.stopped = true
 	a.eventStream <- nil
 	a.batchCond.Broadcast()
 	a.batchCond.L.Unlock()
+	a.pool.cancel(a.id)
+	a.cancel()
+	unregisterAction(a.id)
 }
 
 // isBlocked protect us from poling for more events when the action is blocked.
@@ -202,15 +280,20 @@ func (a *action) batchDispatcher() {
 			batchStart = time.Now()
 		}
 		if timeout || uint64(len(currentBatch)) == a.spec.BatchSize {
-			// We are ready to dispatch the batch
+			// We are ready to dispatch the batch - hand it to the shared pool rather
+			// than running it ourselves, so hundreds of subscriptions don't each need
+			// a dedicated goroutine blocked on the action's own backlog
 			a.batchCond.L.Lock()
 			a.inFlight++
-			a.batchQueue.PushBack(currentBatch)
-			a.batchCond.Broadcast()
+			a.batchCount++
+			batchNumber := a.batchCount
 			a.batchCond.L.Unlock()
+			batch := currentBatch
+			a.pool.submit(a.id, func() { a.processBatch(batchNumber, batch) })
 			currentBatch = []*eventData{}
 		} else {
-			// Just increment in-flight count (batch processor decrements)
+			// Just increment in-flight count (processBatch decrements, once the
+			// pool has run the batch this event ends up in)
 			a.batchCond.L.Lock()
 			a.inFlight++
 			a.batchCond.L.Unlock()
@@ -218,52 +301,42 @@ func (a *action) batchDispatcher() {
 	}
 }
 
-// batchProcessor picks up batches from the batchDispatcher, and performs the blocking
-// actions required to perform the action itself.
-// We use a sync.Cond rather than a channel to communicate with this goroutine, as
-// it might be blocked for very large periods of time
-func (a *action) batchProcessor() {
-	defer func() { a.processorDone = true }()
-	for {
-		// Wait for the next batch, or to be stopped
-		a.batchCond.L.Lock()
-		for !a.stopped && a.batchQueue.Len() == 0 {
-			a.batchCond.Wait()
-		}
-		if a.stopped {
-			return
-		}
-		batchElem := a.batchQueue.Front()
-		a.batchCount++
-		batchNumber := a.batchCount
-		a.batchQueue.Remove(batchElem)
-		a.batchCond.L.Unlock()
-		// Process the batch - could block for a very long time, particularly if
-		// ErrorHandlingBlock is configured.
-		a.processBatch(batchNumber, batchElem.Value.([]*eventData))
-	}
-}
-
-// processBatch is the blocking function to process a batch of events
-// It never returns an error, and uses the chosen block/skip ErrorHandling
-// behaviour combined with the parameters on the event itself
+// processBatch is the blocking function to process a batch of events.
+// It never returns an error, and uses the chosen block/skip/deadletter
+// ErrorHandling behaviour, combined with the circuit breaker if configured,
+// to decide when to give up on a batch rather than retrying it forever.
 func (a *action) processBatch(batchNumber uint64, events []*eventData) {
 	processed := false
 	attempt := 0
+	var lastErr error
 	for !processed {
 		if attempt > 0 {
 			time.Sleep(time.Duration(a.spec.BlockedRetryDelaySec) * time.Second)
 		}
 		attempt++
 		log.Errorf("%s: Batch %d initiated with %d events", a.id, batchNumber, len(events))
-		err := a.performActionWithRetry(batchNumber, events)
+		lastErr = a.performActionWithRetry(batchNumber, events)
 		// If we got an error after all of the internal retries within the event
 		// handler failed, then the ErrorHandling strategy kicks in
-		processed = (err == nil)
+		processed = (lastErr == nil)
 		if !processed {
 			log.Errorf("%s: Batch %d attempt %d failed. ErrorHandling=%s BlockedRetryDelay=%ds",
 				a.id, batchNumber, attempt, a.spec.ErrorHandling, a.spec.BlockedRetryDelaySec)
-			processed = (a.spec.ErrorHandling == ErrorHandlingSkip)
+			breakerOpened := a.recordFailure()
+			switch {
+			case a.spec.ErrorHandling == ErrorHandlingDeadLetter:
+				a.sendToDeadLetter(batchNumber, uint64(attempt), lastErr, events)
+				processed = true
+			case breakerOpened:
+				// The breaker just tripped and suspended dispatching - don't leave
+				// this batch stuck retrying forever on a worker, park it instead
+				a.sendToDeadLetter(batchNumber, uint64(attempt), lastErr, events)
+				processed = true
+			case a.spec.ErrorHandling == ErrorHandlingSkip:
+				processed = true
+			}
+		} else {
+			a.recordSuccess()
 		}
 	}
 	// Call all the callbacks on the events, so they can update their high water marks
@@ -281,97 +354,67 @@ func (a *action) processBatch(batchNumber uint64, events []*eventData) {
 	a.batchCond.L.Unlock()
 }
 
-// performActionWithRetry performs an action, with exponential backoff retry up
-// to a given threshold
+// performActionWithRetry performs an action, with exponential backoff retry
+// (jittered, capped at MaxIntervalMS) up to MaxElapsedSec of wall-clock time.
+// The backoff sleep is interruptible via a.ctx, so stop() returns promptly
+// instead of waiting out whatever delay is currently in progress.
 func (a *action) performActionWithRetry(batchNumber uint64, events []*eventData) (err error) {
-	startTime := time.Now()
-	endTime := startTime.Add(time.Duration(a.spec.RetryTimeoutSec) * time.Second)
-	delay := a.initialRetryDelay
+	b := newBackoff(a.spec.Retry)
 	var attempt uint64
 	complete := false
 	for !a.stopped && !complete {
 		if attempt > 0 {
-			log.Infof("%s: Watiting %.2fs before re-attempting batch %d", a.id, delay.Seconds(), batchNumber)
-			time.Sleep(delay)
-			delay = time.Duration(float64(delay) * a.backoffFactor)
+			delay, withinLimit := b.next()
+			if !withinLimit {
+				break
+			}
+			log.Infof("%s: Waiting %.2fs before re-attempting batch %d", a.id, delay.Seconds(), batchNumber)
+			select {
+			case <-time.After(delay):
+			case <-a.ctx.Done():
+				return a.ctx.Err()
+			}
 		}
 		attempt++
 		switch a.spec.Type {
-		case "webhook":
+		case ActionTypeWebhook:
 			err = a.attemptWebhookAction(batchNumber, attempt, events)
+		case ActionTypeWebSocket:
+			err = a.attemptWebSocketAction(batchNumber, attempt, events)
 		}
-		complete = err == nil || endTime.Sub(time.Now()) < 0
+		complete = err == nil
 	}
 	return err
 }
 
-// isAddressSafe checks for local IPs
-func (a *action) isAddressUnsafe(ip *net.IPAddr) bool {
-	ip4 := ip.IP.To4()
-	return !a.allowPrivateIPs &&
-		(ip4[0] == 0 ||
-			ip4[0] >= 224 ||
-			ip4[0] == 127 ||
-			ip4[0] == 10 ||
-			(ip4[0] == 172 && ip4[1] >= 16 && ip4[1] < 32) ||
-			(ip4[0] == 192 && ip4[1] == 168))
+// attemptWebSocketAction performs a single attempt of a websocket action,
+// handing the batch to the registry for the configured topic/distributionMode
+// and blocking until an ack/nack frame comes back (see wsevents.Registry.Dispatch)
+func (a *action) attemptWebSocketAction(batchNumber, attempt uint64, events []*eventData) error {
+	log.Infof("%s: WS batch %d dispatch to topic '%s' (attempt=%d)", a.id, batchNumber, a.spec.WebSocket.Topic, attempt)
+	err := wsRegistry.Dispatch(a.ctx, a.spec.WebSocket.Topic, a.spec.WebSocket.DistributionMode, a.id, batchNumber, events)
+	if err != nil {
+		log.Errorf("%s: WS batch %d failed (attempt=%d): %s", a.id, batchNumber, attempt, err)
+	} else {
+		log.Infof("%s: WS batch %d ack'd (attempt=%d)", a.id, batchNumber, attempt)
+	}
+	return err
 }
 
-// attemptWebhookAction performs a single attempt of a webhook action
+// attemptWebhookAction performs a single attempt of a webhook action. If the
+// marshalled batch is larger than Webhook.MaxRequestBytes, it is split into
+// sub-batches that are POSTed individually - each sub-batch still has to
+// succeed before the next is sent, so the overall batch is only acked once
+// every sub-batch has been delivered
 func (a *action) attemptWebhookAction(batchNumber, attempt uint64, events []*eventData) error {
-	// We perform DNS resolution explicitly, so that we can exclude private IP address
-	// ranges from the target
-	u, _ := url.Parse(a.spec.Webhook.URL)
-	port := u.Port()
-	addr, err := net.ResolveIPAddr("ip4", u.Hostname())
+	chunks, err := splitWebhookBatch(events, a.spec.Webhook.MaxRequestBytes)
 	if err != nil {
 		return err
 	}
-	if a.isAddressUnsafe(addr) {
-		err := fmt.Errorf("Cannot send Webhook POST to address: %s", u.Hostname())
-		log.Errorf(err.Error())
-		return err
-	}
-	u.Host = addr.String() + ":" + port
-	// Set the timeout
-	var transport = &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   30 * time.Second,
-			KeepAlive: 30 * time.Second,
-			DualStack: true,
-		}).DialContext,
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-	}
-	transport.TLSClientConfig = &tls.Config{
-		InsecureSkipVerify: a.spec.Webhook.TLSkipHostVerify,
-	}
-	netClient := &http.Client{
-		Timeout:   time.Duration(a.spec.Webhook.RequestTimeoutSec) * time.Second,
-		Transport: transport,
-	}
-	log.Infof("POST --> %s (attempt=%d)", u.String(), attempt)
-	reqBytes, err := json.Marshal(&events)
-	if err == nil {
-		var res *http.Response
-		res, err = netClient.Post(u.String(), "application/json", bytes.NewReader(reqBytes))
-		if err == nil {
-			ok := (res.StatusCode >= 200 && res.StatusCode < 300)
-			log.Infof("POST <-- %s [%d] ok=%t", u.String(), res.StatusCode, ok)
-			if !ok || log.IsLevelEnabled(log.DebugLevel) {
-				bodyBytes, _ := ioutil.ReadAll(res.Body)
-				log.Infof("Response body: %s", string(bodyBytes))
-			}
-			if !ok {
-				err = fmt.Errorf("Failed with status=%d", res.StatusCode)
-			}
+	for i, chunk := range chunks {
+		if err := a.postWebhookChunk(batchNumber, attempt, i+1, len(chunks), chunk); err != nil {
+			return err
 		}
 	}
-	if err != nil {
-		log.Errorf("POST %s failed (attempt=%d): %s", u.String(), attempt, err)
-	}
-	return err
+	return nil
 }
@@ -0,0 +1,121 @@
+// Copyright 2019 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldevents
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+const (
+	// DefaultInitialIntervalMS is the delay before the first retry
+	DefaultInitialIntervalMS = 500
+	// DefaultMaxIntervalMS caps how large the backoff delay is allowed to grow
+	DefaultMaxIntervalMS = 60000
+	// DefaultRetryMultiplier is the factor the delay is multiplied by on each attempt
+	DefaultRetryMultiplier = float64(2.0)
+	// DefaultRandomizationFactor jitters the computed delay by +/- this fraction
+	DefaultRandomizationFactor = float64(0.5)
+)
+
+// retrySpec configures the exponential backoff used between attempts of an
+// action, matching the cenkalti/backoff semantics: the delay grows by
+// Multiplier each attempt, capped at MaxIntervalMS, jittered by
+// RandomizationFactor, and the whole retry loop aborts when the next sleep
+// would take it past MaxElapsedSec of wall-clock time since the first
+// attempt. MaxElapsedSec == 0
+// means no cap, but only once Retry has actually been configured - see
+// setDefaults.
+type retrySpec struct {
+	InitialIntervalMS   uint64  `json:"initialIntervalMS,omitempty"`
+	MaxIntervalMS       uint64  `json:"maxIntervalMS,omitempty"`
+	Multiplier          float64 `json:"multiplier,omitempty"`
+	RandomizationFactor float64 `json:"randomizationFactor,omitempty"`
+	MaxElapsedSec       uint64  `json:"maxElapsedSec,omitempty"`
+
+	// singleAttemptOnly preserves the behavior of the old RetryTimeoutSec-only
+	// code path for specs that configure neither it nor Retry: previously an
+	// unset RetryTimeoutSec made performActionWithRetry give up after exactly
+	// one attempt, rather than (as a bare MaxElapsedSec==0 now means) retrying
+	// forever. It is not exposed in actionSpec - there is no way to ask for it
+	// explicitly, it only ever arises from leaving both fields unset.
+	singleAttemptOnly bool
+}
+
+// setDefaults fills in any zero-valued fields with the package defaults.
+// legacyMaxElapsedSec carries over actionSpec.RetryTimeoutSec, so existing
+// specs that only set that field keep their current behavior. retryExplicit
+// is true when the spec configured actionSpec.Retry itself, as opposed to
+// retrySpec being defaulted from a nil actionSpec.Retry.
+func (r *retrySpec) setDefaults(legacyMaxElapsedSec uint64, retryExplicit bool) {
+	if r.InitialIntervalMS == 0 {
+		r.InitialIntervalMS = DefaultInitialIntervalMS
+	}
+	if r.MaxIntervalMS == 0 {
+		r.MaxIntervalMS = DefaultMaxIntervalMS
+	}
+	if r.Multiplier == 0 {
+		r.Multiplier = DefaultRetryMultiplier
+	}
+	if r.RandomizationFactor == 0 {
+		r.RandomizationFactor = DefaultRandomizationFactor
+	}
+	if r.MaxElapsedSec == 0 {
+		switch {
+		case legacyMaxElapsedSec > 0:
+			r.MaxElapsedSec = legacyMaxElapsedSec
+		case retryExplicit:
+			// Retry was configured explicitly and MaxElapsedSec left unset -
+			// that means no cap, same as cenkalti/backoff's MaxElapsedTime: 0
+		default:
+			r.singleAttemptOnly = true
+		}
+	}
+}
+
+// backoff tracks the state of an in-progress retry loop against a retrySpec
+type backoff struct {
+	spec      *retrySpec
+	startTime time.Time
+	attempt   uint64
+}
+
+func newBackoff(spec *retrySpec) *backoff {
+	return &backoff{spec: spec, startTime: time.Now()}
+}
+
+// next returns the delay to sleep before the next attempt, and false if
+// sleeping that delay would pass MaxElapsedSec and the loop should stop instead
+func (b *backoff) next() (time.Duration, bool) {
+	if b.spec.singleAttemptOnly {
+		return 0, false
+	}
+	interval := float64(b.spec.InitialIntervalMS) * math.Pow(b.spec.Multiplier, float64(b.attempt))
+	if max := float64(b.spec.MaxIntervalMS); interval > max {
+		interval = max
+	}
+	b.attempt++
+	r := b.spec.RandomizationFactor
+	jittered := interval * (1 - r + rand.Float64()*2*r)
+	delay := time.Duration(jittered) * time.Millisecond
+	if b.spec.MaxElapsedSec > 0 {
+		maxElapsed := time.Duration(b.spec.MaxElapsedSec) * time.Second
+		if time.Since(b.startTime)+delay > maxElapsed {
+			return 0, false
+		}
+	}
+	return delay, true
+}
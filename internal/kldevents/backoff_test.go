@@ -0,0 +1,57 @@
+// Copyright 2019 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldevents
+
+import "testing"
+
+// TestBackoffNeitherSetSingleAttempt verifies that a spec with neither the
+// legacy RetryTimeoutSec nor an explicit Retry block gives up after exactly
+// one attempt, matching the pre-existing behavior this replaced.
+func TestBackoffNeitherSetSingleAttempt(t *testing.T) {
+	spec := &retrySpec{}
+	spec.setDefaults(0, false)
+	b := newBackoff(spec)
+	if _, ok := b.next(); ok {
+		t.Fatal("expected next() to report no further attempts")
+	}
+}
+
+// TestBackoffLegacyMaxElapsedSec verifies that a non-zero RetryTimeoutSec
+// still caps the retry loop the way it always has.
+func TestBackoffLegacyMaxElapsedSec(t *testing.T) {
+	spec := &retrySpec{}
+	spec.setDefaults(60, false)
+	if spec.MaxElapsedSec != 60 {
+		t.Fatalf("expected MaxElapsedSec=60, got %d", spec.MaxElapsedSec)
+	}
+	b := newBackoff(spec)
+	if _, ok := b.next(); !ok {
+		t.Fatal("expected next() to allow an attempt within MaxElapsedSec")
+	}
+}
+
+// TestBackoffExplicitRetryNoCap verifies that explicitly configuring Retry
+// and leaving MaxElapsedSec unset means no cap, not single-attempt-only.
+func TestBackoffExplicitRetryNoCap(t *testing.T) {
+	spec := &retrySpec{}
+	spec.setDefaults(0, true)
+	if spec.MaxElapsedSec != 0 {
+		t.Fatalf("expected MaxElapsedSec=0 (no cap), got %d", spec.MaxElapsedSec)
+	}
+	b := newBackoff(spec)
+	if _, ok := b.next(); !ok {
+		t.Fatal("expected next() to allow an attempt with no elapsed cap")
+	}
+}
@@ -0,0 +1,302 @@
+// Copyright 2019 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldevents
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// ErrorHandlingDeadLetter processes up to the retry behavior on the action, then
+	// parks the batch in the configured dead-letter sink instead of dropping it
+	ErrorHandlingDeadLetter = "deadletter"
+	// DefaultBreakerThreshold is the number of consecutive failed batches that
+	// trip the circuit breaker, when CircuitBreaker.FailureThreshold is not set
+	DefaultBreakerThreshold = 5
+	// SubscriptionStateSuspended names the state of a subscription whose circuit
+	// breaker is open, pending ResetBreaker or operator intervention. Nothing in
+	// this package sets or reports it; SuspendedSubscriptions returns IDs only.
+	SubscriptionStateSuspended = "suspended"
+)
+
+// circuitBreaker configures when an action is suspended after repeated failures
+type circuitBreaker struct {
+	FailureThreshold uint64 `json:"failureThreshold,omitempty"`
+}
+
+// deadLetterSpec configures where failing batches are parked, so they are not
+// silently dropped by ErrorHandlingSkip, or lost when the circuit breaker trips
+type deadLetterSpec struct {
+	Webhook  *webhookAction `json:"webhook,omitempty"`
+	FilePath string         `json:"filePath,omitempty"`
+}
+
+// deadLetterEntry is one record written to a dead-letter sink
+type deadLetterEntry struct {
+	ActionID    string       `json:"actionId"`
+	BatchNumber uint64       `json:"batchNumber"`
+	Attempts    uint64       `json:"attempts"`
+	LastError   string       `json:"lastError"`
+	Events      []*eventData `json:"events"`
+}
+
+// recordFailure increments the action's consecutive failure count and, if a
+// CircuitBreaker is configured and the threshold is reached, suspends the
+// action's dispatching via the shared pool. Returns true the one time the
+// breaker transitions from closed to open.
+func (a *action) recordFailure() (justOpened bool) {
+	a.batchCond.L.Lock()
+	defer a.batchCond.L.Unlock()
+	a.consecutiveFailures++
+	if a.spec.CircuitBreaker != nil && !a.suspended && a.consecutiveFailures >= a.spec.CircuitBreaker.FailureThreshold {
+		a.suspended = true
+		justOpened = true
+		a.pool.pause(a.id)
+		log.Errorf("%s: Circuit breaker tripped after %d consecutive failures - subscription suspended", a.id, a.consecutiveFailures)
+	}
+	return justOpened
+}
+
+// recordSuccess resets the action's consecutive failure count
+func (a *action) recordSuccess() {
+	a.batchCond.L.Lock()
+	a.consecutiveFailures = 0
+	a.batchCond.L.Unlock()
+}
+
+// isSuspended reports whether the action's circuit breaker is currently open
+func (a *action) isSuspended() bool {
+	a.batchCond.L.Lock()
+	defer a.batchCond.L.Unlock()
+	return a.suspended
+}
+
+// resetBreaker closes the circuit breaker and resumes dispatching
+func (a *action) resetBreaker() {
+	a.batchCond.L.Lock()
+	a.suspended = false
+	a.consecutiveFailures = 0
+	a.batchCond.L.Unlock()
+	a.pool.resume(a.id)
+}
+
+// sendToDeadLetter parks a failing batch in the configured sink(s), with the
+// original events, the number of attempts made, and the last error seen
+func (a *action) sendToDeadLetter(batchNumber, attempts uint64, lastErr error, events []*eventData) {
+	if a.spec.DeadLetter == nil {
+		return
+	}
+	errString := ""
+	if lastErr != nil {
+		errString = lastErr.Error()
+	}
+	entry := &deadLetterEntry{
+		ActionID:    a.id,
+		BatchNumber: batchNumber,
+		Attempts:    attempts,
+		LastError:   errString,
+		Events:      events,
+	}
+	if a.spec.DeadLetter.FilePath != "" {
+		if err := appendDeadLetterFile(a.spec.DeadLetter.FilePath, entry); err != nil {
+			log.Errorf("%s: Failed to write dead-letter entry for batch %d to %s: %s", a.id, batchNumber, a.spec.DeadLetter.FilePath, err)
+		}
+	}
+	if a.spec.DeadLetter.Webhook != nil {
+		if err := postDeadLetterWebhook(a.spec.DeadLetter.Webhook, entry); err != nil {
+			log.Errorf("%s: Failed to POST dead-letter entry for batch %d to %s: %s", a.id, batchNumber, a.spec.DeadLetter.Webhook.URL, err)
+		}
+	}
+}
+
+// deadLetterFileMux serializes appends/reads against dead-letter files, since
+// multiple actions could in principle share a FilePath
+var deadLetterFileMux sync.Mutex
+
+// appendDeadLetterFile writes entry as one line of an append-only JSON-lines file
+func appendDeadLetterFile(filePath string, entry *deadLetterEntry) error {
+	deadLetterFileMux.Lock()
+	defer deadLetterFileMux.Unlock()
+	f, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// readAndClearDeadLetterFile returns every entry currently in filePath for
+// actionID, then rewrites the file with only the other actions' entries -
+// replay is a one-shot drain, not a peek
+func readAndClearDeadLetterFile(filePath, actionID string) ([]*deadLetterEntry, error) {
+	deadLetterFileMux.Lock()
+	defer deadLetterFileMux.Unlock()
+	f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []*deadLetterEntry
+	var remaining []*deadLetterEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		var entry deadLetterEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Errorf("Skipping unparseable dead-letter entry in %s: %s", filePath, err)
+			continue
+		}
+		if entry.ActionID == actionID {
+			entries = append(entries, &entry)
+		} else {
+			remaining = append(remaining, &entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return entries, nil
+	}
+	if err := f.Truncate(0); err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	for _, entry := range remaining {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			return nil, err
+		}
+	}
+	return entries, nil
+}
+
+// postDeadLetterWebhook POSTs entry to a secondary webhook URL, reusing the
+// same deliberately simple timeout as a one-shot best-effort notification
+func postDeadLetterWebhook(webhook *webhookAction, entry *deadLetterEntry) error {
+	body, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	netClient := &http.Client{Timeout: 30 * time.Second}
+	res, err := netClient.Post(webhook.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("dead-letter webhook POST to %s failed with status=%d", webhook.URL, res.StatusCode)
+	}
+	return nil
+}
+
+// actionRegistry is the process-wide set of live actions, keyed by subscription
+// ID, so the REST API layer can inspect/replay/reset a subscription's breaker
+// without threading an action reference through every handler
+var (
+	actionRegistryMux sync.Mutex
+	actionRegistry    = make(map[string]*action)
+)
+
+func registerAction(a *action) {
+	actionRegistryMux.Lock()
+	actionRegistry[a.id] = a
+	actionRegistryMux.Unlock()
+}
+
+func unregisterAction(id string) {
+	actionRegistryMux.Lock()
+	delete(actionRegistry, id)
+	actionRegistryMux.Unlock()
+}
+
+// SuspendedSubscriptions returns the IDs of every subscription whose circuit
+// breaker is currently open. Intended to back a REST endpoint that lists
+// suspended subscriptions for an operator to triage.
+func SuspendedSubscriptions() []string {
+	actionRegistryMux.Lock()
+	defer actionRegistryMux.Unlock()
+	var ids []string
+	for id, a := range actionRegistry {
+		if a.isSuspended() {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// ResetBreaker closes the circuit breaker for a suspended subscription and
+// resumes dispatching. Intended to back a REST endpoint for operator recovery.
+func ResetBreaker(id string) error {
+	actionRegistryMux.Lock()
+	a, ok := actionRegistry[id]
+	actionRegistryMux.Unlock()
+	if !ok {
+		return fmt.Errorf("No active subscription with id '%s'", id)
+	}
+	a.resetBreaker()
+	return nil
+}
+
+// ReplayDeadLetter resubmits every entry currently parked in a subscription's
+// dead-letter sink as a new batch, then clears them from the sink. Only the
+// file-based sink supports replay - a secondary webhook sink is fire-and-forget.
+// Intended to back a REST endpoint for operator-triggered DLQ replay.
+func ReplayDeadLetter(id string) (int, error) {
+	actionRegistryMux.Lock()
+	a, ok := actionRegistry[id]
+	actionRegistryMux.Unlock()
+	if !ok {
+		return 0, fmt.Errorf("No active subscription with id '%s'", id)
+	}
+	if a.spec.DeadLetter == nil || a.spec.DeadLetter.FilePath == "" {
+		return 0, fmt.Errorf("Subscription '%s' has no file-based dead-letter sink to replay", id)
+	}
+	entries, err := readAndClearDeadLetterFile(a.spec.DeadLetter.FilePath, id)
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		e := entry
+		// processBatch always decrements inFlight by len(events) when it finishes,
+		// so it must be incremented here first - exactly as batchDispatcher does
+		// for every normal batch - or inFlight underflows on this uint64.
+		a.batchCond.L.Lock()
+		a.inFlight += uint64(len(e.Events))
+		a.batchCond.L.Unlock()
+		a.pool.submit(a.id, func() { a.processBatch(e.BatchNumber, e.Events) })
+	}
+	return len(entries), nil
+}
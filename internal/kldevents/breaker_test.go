@@ -0,0 +1,293 @@
+// Copyright 2019 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldevents
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestNewActionCircuitBreakerRequiresDeadLetter verifies that configuring a
+// CircuitBreaker without a DeadLetter sink is rejected, rather than allowing
+// a breaker trip to later drop a batch with no record anywhere.
+func TestNewActionCircuitBreakerRequiresDeadLetter(t *testing.T) {
+	spec := &actionSpec{
+		Type:           ActionTypeWebhook,
+		Webhook:        &webhookAction{URL: "http://example.com"},
+		CircuitBreaker: &circuitBreaker{},
+	}
+	if _, err := newAction("action1", false, spec); err == nil {
+		t.Fatal("expected an error when circuitBreaker is set without deadLetter")
+	}
+}
+
+// TestNewActionCircuitBreakerWithDeadLetter verifies the same spec succeeds
+// once a dead-letter sink is configured
+func TestNewActionCircuitBreakerWithDeadLetter(t *testing.T) {
+	spec := &actionSpec{
+		Type:           ActionTypeWebhook,
+		Webhook:        &webhookAction{URL: "http://example.com"},
+		CircuitBreaker: &circuitBreaker{},
+		DeadLetter:     &deadLetterSpec{FilePath: "/tmp/deadletter.jsonl"},
+	}
+	a, err := newAction("action2", false, spec)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	a.stop()
+}
+
+// TestRecordFailureTripsBreakerAtThreshold verifies the breaker stays closed
+// below FailureThreshold, opens on the failure that reaches it (returning
+// justOpened=true exactly once), and stays open - not re-reporting
+// justOpened - on every failure after that.
+func TestRecordFailureTripsBreakerAtThreshold(t *testing.T) {
+	spec := &actionSpec{
+		Type:           ActionTypeWebhook,
+		Webhook:        &webhookAction{URL: "http://example.com"},
+		CircuitBreaker: &circuitBreaker{FailureThreshold: 3},
+		DeadLetter:     &deadLetterSpec{FilePath: filepath.Join(t.TempDir(), "deadletter.jsonl")},
+	}
+	a, err := newAction("breaker-trip", false, spec)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer a.stop()
+
+	for i := 0; i < 2; i++ {
+		if a.recordFailure() {
+			t.Fatalf("breaker opened after only %d failures, threshold is 3", i+1)
+		}
+		if a.isSuspended() {
+			t.Fatal("breaker reported suspended before reaching the threshold")
+		}
+	}
+	if !a.recordFailure() {
+		t.Fatal("expected the 3rd consecutive failure to open the breaker")
+	}
+	if !a.isSuspended() {
+		t.Fatal("expected the breaker to be suspended once the threshold is reached")
+	}
+	if a.recordFailure() {
+		t.Fatal("expected justOpened=false on a failure after the breaker is already open")
+	}
+}
+
+// TestRecordSuccessResetsFailureCount verifies a success clears the
+// consecutive failure count, so an intermittent failure doesn't creep the
+// action towards the threshold over an unrelated string of successes.
+func TestRecordSuccessResetsFailureCount(t *testing.T) {
+	spec := &actionSpec{
+		Type:           ActionTypeWebhook,
+		Webhook:        &webhookAction{URL: "http://example.com"},
+		CircuitBreaker: &circuitBreaker{FailureThreshold: 2},
+		DeadLetter:     &deadLetterSpec{FilePath: filepath.Join(t.TempDir(), "deadletter.jsonl")},
+	}
+	a, err := newAction("breaker-reset-count", false, spec)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer a.stop()
+
+	a.recordFailure()
+	a.recordSuccess()
+	if a.recordFailure() {
+		t.Fatal("expected the failure count to have been reset by recordSuccess")
+	}
+}
+
+// TestResetBreakerReopensForNewFailures verifies ResetBreaker closes an open
+// breaker and clears its failure count, so the action can trip again from
+// a fresh string of failures rather than being stuck suspended or staying
+// one failure away from immediately re-tripping.
+func TestResetBreakerReopensForNewFailures(t *testing.T) {
+	spec := &actionSpec{
+		Type:           ActionTypeWebhook,
+		Webhook:        &webhookAction{URL: "http://example.com"},
+		CircuitBreaker: &circuitBreaker{FailureThreshold: 2},
+		DeadLetter:     &deadLetterSpec{FilePath: filepath.Join(t.TempDir(), "deadletter.jsonl")},
+	}
+	a, err := newAction("breaker-resetbreaker", false, spec)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer a.stop()
+
+	a.recordFailure()
+	a.recordFailure()
+	if !a.isSuspended() {
+		t.Fatal("expected the breaker to be open after two failures (threshold=2)")
+	}
+	if err := ResetBreaker(a.id); err != nil {
+		t.Fatalf("unexpected error from ResetBreaker: %s", err)
+	}
+	if a.isSuspended() {
+		t.Fatal("expected the breaker to be closed after ResetBreaker")
+	}
+	if a.recordFailure() {
+		t.Fatal("expected a single failure after reset not to immediately re-report justOpened")
+	}
+}
+
+// TestDeadLetterFileRoundTrip verifies an entry written via
+// appendDeadLetterFile is returned by readAndClearDeadLetterFile, and that
+// the read is a one-shot drain: a second read for the same action returns
+// nothing because its entries were removed from the file, while another
+// action's entry is kept.
+func TestDeadLetterFileRoundTrip(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "deadletter.jsonl")
+
+	entry := &deadLetterEntry{
+		ActionID:  "action1",
+		Attempts:  2,
+		LastError: "boom",
+		Events:    []*eventData{{SubID: "sub1"}},
+	}
+	if err := appendDeadLetterFile(filePath, entry); err != nil {
+		t.Fatalf("unexpected error appending: %s", err)
+	}
+	// an entry for a different action must survive the first action's replay
+	other := &deadLetterEntry{ActionID: "action2", Events: []*eventData{{SubID: "sub2"}}}
+	if err := appendDeadLetterFile(filePath, other); err != nil {
+		t.Fatalf("unexpected error appending: %s", err)
+	}
+
+	entries, err := readAndClearDeadLetterFile(filePath, "action1")
+	if err != nil {
+		t.Fatalf("unexpected error reading: %s", err)
+	}
+	if len(entries) != 1 || entries[0].LastError != "boom" || entries[0].Attempts != 2 {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+
+	// the drain for action1 must not have consumed action2's entry
+	entries, err = readAndClearDeadLetterFile(filePath, "action1")
+	if err != nil {
+		t.Fatalf("unexpected error on second read: %s", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected the dead-letter file to have been drained, got %+v", entries)
+	}
+
+	entries, err = readAndClearDeadLetterFile(filePath, "action2")
+	if err != nil {
+		t.Fatalf("unexpected error reading action2's entry: %s", err)
+	}
+	if len(entries) != 1 || entries[0].Events[0].SubID != "sub2" {
+		t.Fatalf("expected action2's entry to have survived action1's replay, got %+v", entries)
+	}
+}
+
+// TestReplayDeadLetterIncrementsInFlight verifies ReplayDeadLetter increments
+// inFlight for the replayed batch before submitting it to the pool - the
+// regression test for the underflow that previously left IsBlocked() stuck
+// true forever after a single replay. The action's dispatching is paused
+// first, so the assertion observes the increment rather than racing the
+// pool's own decrement once the batch is actually processed.
+func TestReplayDeadLetterIncrementsInFlight(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "deadletter.jsonl")
+	spec := &actionSpec{
+		Type:           ActionTypeWebhook,
+		Webhook:        &webhookAction{URL: "http://example.com"},
+		CircuitBreaker: &circuitBreaker{FailureThreshold: 1},
+		DeadLetter:     &deadLetterSpec{FilePath: filePath},
+	}
+	a, err := newAction("replay-inflight", false, spec)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer a.stop()
+
+	events := []*eventData{{SubID: "sub1"}, {SubID: "sub2"}}
+	if err := appendDeadLetterFile(filePath, &deadLetterEntry{ActionID: a.id, BatchNumber: 1, Events: events}); err != nil {
+		t.Fatalf("unexpected error appending: %s", err)
+	}
+
+	// pause dispatching so the replayed job sits queued, letting us observe
+	// inFlight before the pool's worker would otherwise decrement it back down
+	a.pool.pause(a.id)
+
+	n, err := ReplayDeadLetter(a.id)
+	if err != nil {
+		t.Fatalf("unexpected error from ReplayDeadLetter: %s", err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 replayed entry, got %d", n)
+	}
+
+	a.batchCond.L.Lock()
+	inFlight := a.inFlight
+	a.batchCond.L.Unlock()
+	if inFlight != uint64(len(events)) {
+		t.Fatalf("expected inFlight=%d for the replayed batch's events, got %d", len(events), inFlight)
+	}
+	if !a.IsBlocked() {
+		t.Fatal("expected the action to report blocked while the replayed batch is in flight")
+	}
+}
+
+// TestReplayDeadLetterUnknownSubscription verifies that, as with ResetBreaker,
+// an ID that isn't a live subscription is rejected with an error
+func TestReplayDeadLetterUnknownSubscription(t *testing.T) {
+	if _, err := ReplayDeadLetter("does-not-exist"); err == nil {
+		t.Fatal("expected an error for an unknown subscription ID")
+	}
+}
+
+// TestReplayDeadLetterRequiresFileSink verifies a subscription with only a
+// webhook dead-letter sink is rejected, since only the file-based sink
+// supports being read back for replay
+func TestReplayDeadLetterRequiresFileSink(t *testing.T) {
+	spec := &actionSpec{
+		Type:           ActionTypeWebhook,
+		Webhook:        &webhookAction{URL: "http://example.com"},
+		CircuitBreaker: &circuitBreaker{FailureThreshold: 1},
+		DeadLetter:     &deadLetterSpec{Webhook: &webhookAction{URL: "http://example.com/deadletter"}},
+	}
+	a, err := newAction("replay-webhook-only", false, spec)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer a.stop()
+
+	if _, err := ReplayDeadLetter(a.id); err == nil {
+		t.Fatal("expected an error replaying a subscription with no file-based dead-letter sink")
+	}
+}
+
+// TestAppendDeadLetterFileMultipleEntries is a minimal sanity check that
+// distinct entries appended for the same action both come back, preserving
+// order, confirming appendDeadLetterFile never overwrites a prior entry
+func TestAppendDeadLetterFileMultipleEntries(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "deadletter.jsonl")
+	for i := 1; i <= 3; i++ {
+		entry := &deadLetterEntry{ActionID: "action1", BatchNumber: uint64(i)}
+		if err := appendDeadLetterFile(filePath, entry); err != nil {
+			t.Fatalf("unexpected error appending entry %d: %s", i, err)
+		}
+	}
+	entries, err := readAndClearDeadLetterFile(filePath, "action1")
+	if err != nil {
+		t.Fatalf("unexpected error reading: %s", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("expected 3 entries, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.BatchNumber != uint64(i+1) {
+			t.Fatalf("expected entries in append order, got %+v", entries)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Copyright 2019 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldevents
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultEventStreamPoolSize is the number of worker goroutines shared across
+// every action, used when EventStreamPoolSize is not configured
+const DefaultEventStreamPoolSize = 10
+
+// DefaultConcurrency is the number of batches an individual action is allowed
+// to have in-flight within the shared pool at once, preserving today's
+// one-batch-at-a-time behavior when actionSpec.Concurrency is not set
+const DefaultConcurrency = 1
+
+// batchJob is a unit of work queued on the dispatcherPool
+type batchJob struct {
+	actionID string
+	run      func()
+}
+
+// dispatcherPool is a bounded set of worker goroutines shared by every action
+// in the event stream manager, replacing the one-dispatcher-goroutine-per-action
+// model. Each action still only ever has actionSpec.Concurrency of its own
+// batches running at once - the pool just bounds total concurrency across all
+// actions, and gives fairness between subscriptions via oldest-batch-first
+// scheduling instead of each action blocking its own dedicated goroutine.
+//
+// queue is kept in plain submission order (submit always appends), so a
+// front-to-back scan of it is already oldest-first - there is no need for a
+// priority heap on top of an order the slice already has.
+type dispatcherPool struct {
+	mux      sync.Mutex
+	cond     *sync.Cond
+	queue    []*batchJob
+	inFlight map[string]uint64
+	limits   map[string]uint64
+	paused   map[string]bool
+	stopped  bool
+}
+
+// newDispatcherPool starts numWorkers goroutines that will service batches
+// submitted via submit() until stop() is called
+func newDispatcherPool(numWorkers int) *dispatcherPool {
+	if numWorkers <= 0 {
+		numWorkers = DefaultEventStreamPoolSize
+	}
+	p := &dispatcherPool{
+		inFlight: make(map[string]uint64),
+		limits:   make(map[string]uint64),
+		paused:   make(map[string]bool),
+	}
+	p.cond = sync.NewCond(&p.mux)
+	for i := 0; i < numWorkers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+// stop terminates every worker goroutine once it finishes whatever job it is
+// currently running. Any jobs still queued are abandoned. Used when a pool is
+// being retired, eg. by EventStreamPoolSize replacing the shared pool.
+func (p *dispatcherPool) stop() {
+	p.mux.Lock()
+	p.stopped = true
+	p.mux.Unlock()
+	p.cond.Broadcast()
+}
+
+// setLimit registers (or updates) the concurrency limit for an action, ie. the
+// maximum number of that action's batches the pool will run at once
+func (p *dispatcherPool) setLimit(actionID string, concurrency uint64) {
+	if concurrency == 0 {
+		concurrency = DefaultConcurrency
+	}
+	p.mux.Lock()
+	p.limits[actionID] = concurrency
+	p.mux.Unlock()
+}
+
+// submit queues a batch for actionID, to be run on a worker goroutine as soon
+// as one is free and the action is under its concurrency limit
+func (p *dispatcherPool) submit(actionID string, run func()) {
+	p.mux.Lock()
+	p.queue = append(p.queue, &batchJob{actionID: actionID, run: run})
+	p.mux.Unlock()
+	p.cond.Broadcast()
+}
+
+// cancel removes every not-yet-started job queued for actionID, and forgets
+// its concurrency limit. Used when a subscription is torn down, so its
+// backlog doesn't keep dispatching batches for a stream that no longer exists.
+// It does not affect a batch for actionID that a worker has already picked up.
+func (p *dispatcherPool) cancel(actionID string) (removed int) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	kept := p.queue[:0]
+	for _, job := range p.queue {
+		if job.actionID == actionID {
+			removed++
+			continue
+		}
+		kept = append(kept, job)
+	}
+	p.queue = kept
+	delete(p.limits, actionID)
+	delete(p.paused, actionID)
+	return removed
+}
+
+// pause stops the pool from starting any further batches for actionID - used
+// when an action's circuit breaker opens. Jobs already queued simply wait;
+// they are not removed, so resume() picks up exactly where it left off.
+func (p *dispatcherPool) pause(actionID string) {
+	p.mux.Lock()
+	p.paused[actionID] = true
+	p.mux.Unlock()
+}
+
+// resume allows the pool to start batches for actionID again, and wakes the
+// workers so a queued backlog is picked up immediately
+func (p *dispatcherPool) resume(actionID string) {
+	p.mux.Lock()
+	delete(p.paused, actionID)
+	p.mux.Unlock()
+	p.cond.Broadcast()
+}
+
+// nextRunnable scans the queue oldest-first (its natural append order) for a
+// job whose action is not paused and has not hit its configured concurrency
+// limit, returning its index in p.queue. Must be called with p.mux held.
+func (p *dispatcherPool) nextRunnable() (*batchJob, int) {
+	for i, job := range p.queue {
+		if p.paused[job.actionID] {
+			continue
+		}
+		limit := p.limits[job.actionID]
+		if limit == 0 {
+			limit = DefaultConcurrency
+		}
+		if p.inFlight[job.actionID] < limit {
+			return job, i
+		}
+	}
+	return nil, -1
+}
+
+func (p *dispatcherPool) worker() {
+	for {
+		p.mux.Lock()
+		var job *batchJob
+		for {
+			if p.stopped {
+				p.mux.Unlock()
+				return
+			}
+			var idx int
+			job, idx = p.nextRunnable()
+			if job != nil {
+				p.queue = append(p.queue[:idx], p.queue[idx+1:]...)
+				break
+			}
+			p.cond.Wait()
+		}
+		p.inFlight[job.actionID]++
+		p.mux.Unlock()
+
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Errorf("Recovered panic in event stream pool job for action %s: %s", job.actionID, r)
+				}
+			}()
+			job.run()
+		}()
+
+		p.mux.Lock()
+		p.inFlight[job.actionID]--
+		p.mux.Unlock()
+		// Wake other workers - this action's slot may have freed up for a queued job
+		p.cond.Broadcast()
+	}
+}
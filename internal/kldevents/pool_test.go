@@ -0,0 +1,108 @@
+// Copyright 2019 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldevents
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestDispatcherPoolOldestFirst verifies that once an in-flight job for
+// actionA frees its only slot, a backlog of several waiting actionA jobs
+// is run in the order they were submitted.
+func TestDispatcherPoolOldestFirst(t *testing.T) {
+	p := newDispatcherPool(1)
+	defer p.stop()
+	p.setLimit("a", 1)
+
+	var mux sync.Mutex
+	var order []int
+	done := make(chan struct{})
+
+	// occupy the single worker so every submission below queues up first
+	block := make(chan struct{})
+	p.submit("a", func() { <-block })
+
+	for i := 0; i < 5; i++ {
+		i := i
+		p.submit("a", func() {
+			mux.Lock()
+			order = append(order, i)
+			mux.Unlock()
+			if i == 4 {
+				close(done)
+			}
+		})
+	}
+	close(block)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for queued jobs to run")
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	for i, v := range order {
+		if v != i {
+			t.Fatalf("expected FIFO order 0..4, got %v", order)
+		}
+	}
+}
+
+// TestDispatcherPoolStop verifies that stop() lets every worker goroutine exit
+func TestDispatcherPoolStop(t *testing.T) {
+	p := newDispatcherPool(2)
+	ran := make(chan struct{})
+	p.submit("a", func() { close(ran) })
+	<-ran
+	p.stop()
+
+	// Workers check p.stopped before taking a job, so a submit after stop()
+	// must never run; if one did, the select below would fail the test
+	done := make(chan struct{})
+	p.submit("a", func() { close(done) })
+	select {
+	case <-done:
+		t.Fatal("job ran after pool was stopped")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+// TestDispatcherPoolPauseResume verifies breaker-style pause/resume
+func TestDispatcherPoolPauseResume(t *testing.T) {
+	p := newDispatcherPool(1)
+	defer p.stop()
+	p.setLimit("a", 1)
+	p.pause("a")
+
+	ran := make(chan struct{})
+	p.submit("a", func() { close(ran) })
+
+	select {
+	case <-ran:
+		t.Fatal("paused action's job ran")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	p.resume("a")
+	select {
+	case <-ran:
+	case <-time.After(5 * time.Second):
+		t.Fatal("resumed action's job never ran")
+	}
+}
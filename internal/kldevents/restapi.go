@@ -0,0 +1,99 @@
+// Copyright 2019 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldevents
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// AddRoutes registers the event stream circuit breaker / dead-letter operator
+// endpoints, and the WebSocket action delivery endpoint, onto mux:
+//
+//   GET  /eventstreams/suspended                    - list suspended subscriptions
+//   POST /eventstreams/{id}/resetbreaker             - close the breaker and resume dispatching
+//   POST /eventstreams/{id}/replaydeadletter          - resubmit and clear a subscription's dead-letter file
+//   GET  /eventstreams/ws/{topic}                    - upgrade to a WebSocket attached to {topic}
+func AddRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/eventstreams/suspended", handleSuspendedSubscriptions)
+	mux.HandleFunc("/eventstreams/ws/", handleWebSocketConnect)
+	mux.HandleFunc("/eventstreams/", handleSubscriptionAction)
+}
+
+func handleSuspendedSubscriptions(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(res, http.StatusOK, SuspendedSubscriptions())
+}
+
+// handleSubscriptionAction dispatches /eventstreams/{id}/resetbreaker and
+// /eventstreams/{id}/replaydeadletter, the only two per-subscription operator
+// actions exposed today
+func handleSubscriptionAction(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/eventstreams/")
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 || parts[0] == "" {
+		http.Error(res, "Must specify a subscription ID and action", http.StatusBadRequest)
+		return
+	}
+	id, action := parts[0], parts[1]
+	switch action {
+	case "resetbreaker":
+		if err := ResetBreaker(id); err != nil {
+			http.Error(res, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(res, http.StatusOK, map[string]string{"status": "reset"})
+	case "replaydeadletter":
+		replayed, err := ReplayDeadLetter(id)
+		if err != nil {
+			http.Error(res, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(res, http.StatusOK, map[string]int{"replayed": replayed})
+	default:
+		http.Error(res, "Unknown action '"+action+"'", http.StatusNotFound)
+	}
+}
+
+// handleWebSocketConnect upgrades a GET /eventstreams/ws/{topic} request to a
+// WebSocket, attaching it to {topic} in wsRegistry for the connection's
+// lifetime - this is the concrete attach point that a 'websocket' action's
+// Dispatch calls are waiting for a client to show up on
+func handleWebSocketConnect(res http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(res, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	topic := strings.TrimPrefix(req.URL.Path, "/eventstreams/ws/")
+	if topic == "" {
+		http.Error(res, "Must specify a topic", http.StatusBadRequest)
+		return
+	}
+	wsRegistry.ServeHTTP(res, req, topic)
+}
+
+func writeJSON(res http.ResponseWriter, status int, body interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	_ = json.NewEncoder(res).Encode(body)
+}
@@ -0,0 +1,51 @@
+// Copyright 2019 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldevents
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestRESTAPISuspendedSubscriptions verifies the list endpoint is wired to
+// SuspendedSubscriptions and responds even when nothing is suspended
+func TestRESTAPISuspendedSubscriptions(t *testing.T) {
+	mux := http.NewServeMux()
+	AddRoutes(mux)
+
+	req := httptest.NewRequest(http.MethodGet, "/eventstreams/suspended", nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+}
+
+// TestRESTAPIResetBreakerUnknownSubscription verifies an unknown subscription
+// ID is reported as 404 rather than a panic or 500
+func TestRESTAPIResetBreakerUnknownSubscription(t *testing.T) {
+	mux := http.NewServeMux()
+	AddRoutes(mux)
+
+	req := httptest.NewRequest(http.MethodPost, "/eventstreams/does-not-exist/resetbreaker", nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", rec.Code)
+	}
+}
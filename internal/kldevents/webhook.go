@@ -0,0 +1,174 @@
+// Copyright 2019 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldevents
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultMaxRequestBytes is the default cap on a single webhook POST body,
+	// above which the batch is split into smaller sub-batches
+	DefaultMaxRequestBytes = 5 * 1024 * 1024
+	// DefaultMaxResponseBytes is the default cap on how much of a webhook's
+	// response body we will read, to protect against a misbehaving receiver
+	DefaultMaxResponseBytes = 1 * 1024 * 1024
+)
+
+// ErrResponseTooLarge is wrapped into the error returned when a webhook
+// response exceeds Webhook.MaxResponseBytes, so operators can alert on it
+// distinctly from a regular failed status code
+var ErrResponseTooLarge = errors.New("webhook response exceeded maximum allowed size")
+
+// isAddressUnsafe checks for local/internal IPs, to protect against SSRF
+// against a webhook URL that resolves to the deployment's own network
+func (a *action) isAddressUnsafe(ip *net.IPAddr) bool {
+	ip4 := ip.IP.To4()
+	return !a.allowPrivateIPs &&
+		(ip4[0] == 0 ||
+			ip4[0] >= 224 ||
+			ip4[0] == 127 ||
+			ip4[0] == 10 ||
+			(ip4[0] == 172 && ip4[1] >= 16 && ip4[1] < 32) ||
+			(ip4[0] == 192 && ip4[1] == 168))
+}
+
+// splitWebhookBatch splits events into sub-batches whose marshalled JSON is no
+// larger than maxBytes, preserving order. An event that alone exceeds maxBytes
+// is put in a sub-batch by itself, which is then larger than maxBytes. If the
+// whole batch already fits (or maxBytes is unset) it is returned as a single chunk.
+func splitWebhookBatch(events []*eventData, maxBytes uint64) ([][]*eventData, error) {
+	if maxBytes == 0 || len(events) == 0 {
+		return [][]*eventData{events}, nil
+	}
+	full, err := json.Marshal(&events)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(full)) <= maxBytes {
+		return [][]*eventData{events}, nil
+	}
+
+	var chunks [][]*eventData
+	var current []*eventData
+	var currentSize uint64 = 2 // enclosing '[' ']'
+	for _, event := range events {
+		eventBytes, err := json.Marshal(event)
+		if err != nil {
+			return nil, err
+		}
+		size := uint64(len(eventBytes)) + 1 // separating comma
+		if len(current) > 0 && currentSize+size > maxBytes {
+			chunks = append(chunks, current)
+			current = nil
+			currentSize = 2
+		}
+		current = append(current, event)
+		currentSize += size
+	}
+	if len(current) > 0 {
+		chunks = append(chunks, current)
+	}
+	return chunks, nil
+}
+
+// postWebhookChunk performs a single HTTP POST of one (sub-)batch of events
+func (a *action) postWebhookChunk(batchNumber, attempt uint64, chunkNumber, chunkCount int, events []*eventData) error {
+	// We perform DNS resolution explicitly, so that we can exclude private IP address
+	// ranges from the target
+	u, _ := url.Parse(a.spec.Webhook.URL)
+	port := u.Port()
+	addr, err := net.ResolveIPAddr("ip4", u.Hostname())
+	if err != nil {
+		return err
+	}
+	if a.isAddressUnsafe(addr) {
+		err := fmt.Errorf("Cannot send Webhook POST to address: %s", u.Hostname())
+		log.Errorf(err.Error())
+		return err
+	}
+	u.Host = addr.String() + ":" + port
+	// Set the timeout
+	var transport = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	transport.TLSClientConfig = &tls.Config{
+		InsecureSkipVerify: a.spec.Webhook.TLSkipHostVerify,
+	}
+	netClient := &http.Client{
+		Timeout:   time.Duration(a.spec.Webhook.RequestTimeoutSec) * time.Second,
+		Transport: transport,
+	}
+	log.Infof("POST --> %s (attempt=%d, chunk=%d/%d)", u.String(), attempt, chunkNumber, chunkCount)
+	reqBytes, err := json.Marshal(&events)
+	if err == nil {
+		var res *http.Response
+		res, err = netClient.Post(u.String(), "application/json", bytes.NewReader(reqBytes))
+		if err == nil {
+			defer res.Body.Close()
+			ok := (res.StatusCode >= 200 && res.StatusCode < 300)
+			bodyBytes, readErr := readLimited(res.Body, a.spec.Webhook.MaxResponseBytes)
+			log.Infof("POST <-- %s [%d] ok=%t", u.String(), res.StatusCode, ok)
+			if readErr != nil {
+				err = readErr
+			} else if !ok || log.IsLevelEnabled(log.DebugLevel) {
+				log.Infof("Response body: %s", string(bodyBytes))
+			}
+			if err == nil && !ok {
+				err = fmt.Errorf("Failed with status=%d", res.StatusCode)
+			}
+		}
+	}
+	if err != nil {
+		log.Errorf("POST %s failed (attempt=%d, chunk=%d/%d): %s", u.String(), attempt, chunkNumber, chunkCount, err)
+	}
+	return err
+}
+
+// readLimited reads up to maxBytes of body, returning ErrResponseTooLarge if
+// there was more to read, so a receiver streaming an unbounded response can't
+// be used to exhaust memory
+func readLimited(body io.Reader, maxBytes uint64) ([]byte, error) {
+	limited := io.LimitReader(body, int64(maxBytes)+1)
+	bodyBytes, err := ioutil.ReadAll(limited)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(bodyBytes)) > maxBytes {
+		return nil, fmt.Errorf("%w (limit=%d bytes)", ErrResponseTooLarge, maxBytes)
+	}
+	return bodyBytes, nil
+}
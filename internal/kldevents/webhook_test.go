@@ -0,0 +1,117 @@
+// Copyright 2019 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kldevents
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// TestSplitWebhookBatchFitsWhole verifies a batch under maxBytes (or with
+// maxBytes unset) is returned as a single chunk, not split needlessly
+func TestSplitWebhookBatchFitsWhole(t *testing.T) {
+	events := []*eventData{{SubID: "sub1"}, {SubID: "sub2"}}
+
+	chunks, err := splitWebhookBatch(events, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(chunks) != 1 || len(chunks[0]) != 2 {
+		t.Fatalf("expected a single chunk of 2 events with maxBytes=0, got %v", chunks)
+	}
+
+	chunks, err = splitWebhookBatch(events, 1024*1024)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(chunks) != 1 || len(chunks[0]) != 2 {
+		t.Fatalf("expected a single chunk of 2 events well within maxBytes, got %v", chunks)
+	}
+}
+
+// TestSplitWebhookBatchOversized verifies an oversized batch is split into
+// multiple non-empty sub-batches that together hold every event, in order
+func TestSplitWebhookBatchOversized(t *testing.T) {
+	events := make([]*eventData, 10)
+	for i := range events {
+		events[i] = &eventData{SubID: strings.Repeat("x", 100)}
+	}
+
+	chunks, err := splitWebhookBatch(events, 300)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(chunks) < 2 {
+		t.Fatalf("expected the batch to be split into multiple chunks, got %d", len(chunks))
+	}
+
+	var reassembled []*eventData
+	for _, chunk := range chunks {
+		if len(chunk) == 0 {
+			t.Fatal("found an empty chunk")
+		}
+		reassembled = append(reassembled, chunk...)
+	}
+	if len(reassembled) != len(events) {
+		t.Fatalf("expected %d events across all chunks, got %d", len(events), len(reassembled))
+	}
+	for i, e := range reassembled {
+		if e != events[i] {
+			t.Fatalf("event order not preserved at index %d", i)
+		}
+	}
+}
+
+// TestSplitWebhookBatchSingleEventExceedsMax verifies a single event larger
+// than maxBytes still gets its own chunk, rather than being dropped or
+// causing an infinite loop
+func TestSplitWebhookBatchSingleEventExceedsMax(t *testing.T) {
+	events := []*eventData{{SubID: strings.Repeat("x", 1000)}}
+	chunks, err := splitWebhookBatch(events, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(chunks) != 1 || len(chunks[0]) != 1 {
+		t.Fatalf("expected the oversized event in its own chunk, got %v", chunks)
+	}
+}
+
+// TestReadLimitedWithinBounds verifies a response body within maxBytes is
+// read in full
+func TestReadLimitedWithinBounds(t *testing.T) {
+	body := bytes.NewReader([]byte("hello"))
+	data, err := readLimited(body, 10)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if string(data) != "hello" {
+		t.Fatalf("expected 'hello', got %q", data)
+	}
+}
+
+// TestReadLimitedExceedsMax verifies a response body over maxBytes is
+// rejected with ErrResponseTooLarge, rather than being read into memory in full
+func TestReadLimitedExceedsMax(t *testing.T) {
+	body := bytes.NewReader([]byte("hello world"))
+	_, err := readLimited(body, 5)
+	if err == nil {
+		t.Fatal("expected an error for a body exceeding maxBytes")
+	}
+	if !errors.Is(err, ErrResponseTooLarge) {
+		t.Fatalf("expected ErrResponseTooLarge, got %s", err)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2019 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wsevents
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+// upgrader is the shared websocket.Upgrader used to accept every inbound
+// connection. Buffer sizes are left at the gorilla defaults, matching every
+// batch/ack frame we exchange being small JSON.
+var upgrader = websocket.Upgrader{}
+
+// connIDCounter hands out unique IDs to connections accepted by ServeHTTP, so
+// Detach can tell two connections from the same remote address apart
+var connIDCounter uint64
+
+// wsConnection adapts a *websocket.Conn to the Connection interface. Writes
+// are serialized with a mutex because gorilla/websocket does not allow
+// concurrent writers on the same connection, but Send can be called from
+// whichever Dispatch goroutine currently owns the round-robin slot.
+type wsConnection struct {
+	id   string
+	conn *websocket.Conn
+	mux  sync.Mutex
+}
+
+func (c *wsConnection) ID() string { return c.id }
+
+func (c *wsConnection) Send(msg interface{}) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.conn.WriteJSON(msg)
+}
+
+// ServeHTTP upgrades req to a WebSocket connection, attaches it to topicName
+// for the lifetime of the connection, and feeds every inbound ack/nack frame
+// to HandleAck. It blocks until the connection is closed or errors, so it is
+// intended to be called directly from an http.HandlerFunc.
+func (r *Registry) ServeHTTP(res http.ResponseWriter, req *http.Request, topicName string) {
+	conn, err := upgrader.Upgrade(res, req, nil)
+	if err != nil {
+		log.Errorf("WS upgrade failed for topic '%s': %s", topicName, err)
+		return
+	}
+	defer conn.Close()
+
+	wsConn := &wsConnection{
+		id:   fmt.Sprintf("ws-%d-%s", atomic.AddUint64(&connIDCounter, 1), req.RemoteAddr),
+		conn: conn,
+	}
+	r.Attach(topicName, wsConn)
+	defer r.Detach(topicName, wsConn)
+
+	for {
+		var ack AckMessage
+		if err := conn.ReadJSON(&ack); err != nil {
+			log.Infof("WS connection %s on topic '%s' closed: %s", wsConn.ID(), topicName, err)
+			return
+		}
+		r.HandleAck(topicName, &ack)
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2019 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wsevents
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// TestServeHTTPRoundTrip verifies a real WebSocket client can attach via
+// ServeHTTP, receive a dispatched batch, and ack it to complete Dispatch -
+// the end-to-end path a 'websocket' action actually depends on in production.
+func TestServeHTTPRoundTrip(t *testing.T) {
+	r := NewRegistry()
+	srv := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		r.ServeHTTP(res, req, "topic1")
+	}))
+	defer srv.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(srv.URL, "http")
+	client, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("failed to dial test server: %s", err)
+	}
+	defer client.Close()
+
+	// Give the server goroutine a moment to Attach before we Dispatch
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Dispatch(context.Background(), "topic1", DistributionModeLoadBalance, "action1", 1, "events")
+	}()
+
+	var batch BatchMessage
+	if err := client.ReadJSON(&batch); err != nil {
+		t.Fatalf("failed to read dispatched batch: %s", err)
+	}
+	if batch.ActionID != "action1" || batch.BatchNumber != 1 {
+		t.Fatalf("unexpected batch message: %+v", batch)
+	}
+
+	if err := client.WriteJSON(&AckMessage{Type: "ack", ActionID: batch.ActionID, BatchNumber: batch.BatchNumber}); err != nil {
+		t.Fatalf("failed to write ack: %s", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error from Dispatch: %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for Dispatch to complete via the real WS round trip")
+	}
+}
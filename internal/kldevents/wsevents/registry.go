@@ -0,0 +1,209 @@
+// Copyright 2019 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package wsevents fans event batches out over WebSocket connections attached
+// to a topic, and tracks the ack/nack frames that come back from clients so
+// the caller knows when it is safe to advance a checkpoint.
+package wsevents
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// DistributionModeLoadBalance round-robins each batch to a single attached client
+	DistributionModeLoadBalance = "load_balance"
+	// DistributionModeBroadcast sends each batch to every attached client
+	DistributionModeBroadcast = "broadcast"
+)
+
+// Connection is the minimal interface a WebSocket connection must satisfy to
+// be attached to a topic. It is implemented by wsConnection, a thin wrapper
+// around *websocket.Conn used by Registry.ServeHTTP, and by test doubles here.
+type Connection interface {
+	ID() string
+	Send(msg interface{}) error
+}
+
+// BatchMessage is the frame written to attached clients for a dispatched batch
+type BatchMessage struct {
+	Type        string      `json:"type"`
+	ActionID    string      `json:"actionId"`
+	BatchNumber uint64      `json:"batchNumber"`
+	Events      interface{} `json:"events"`
+}
+
+// AckMessage is the frame a client sends back to ack, or nack, a batch. It
+// must echo back the ActionID and BatchNumber from the BatchMessage being
+// acked, since the pair - not BatchNumber alone - identifies the Dispatch
+// call to complete when multiple actions share a topic.
+type AckMessage struct {
+	Type        string `json:"type"`
+	ActionID    string `json:"actionId"`
+	BatchNumber uint64 `json:"batchNumber"`
+	Error       string `json:"error,omitempty"`
+}
+
+// pendingKey identifies one in-flight Dispatch call on a topic. batchNumber
+// alone is not unique: it is a per-action sequence that restarts at 1 for
+// every subscription, and load_balance/broadcast both let multiple actions
+// share a topic, so actionID is needed to disambiguate whose batch N an ack
+// belongs to.
+type pendingKey struct {
+	actionID    string
+	batchNumber uint64
+}
+
+// topic fans batches out to whichever connections are currently attached to it
+type topic struct {
+	mux        sync.Mutex
+	conns      []Connection
+	roundRobin int
+	pending    map[pendingKey]chan error
+}
+
+// Registry owns every topic attached to by websocket action subscribers, and
+// is shared across all websocket actions in the process
+type Registry struct {
+	mux    sync.Mutex
+	topics map[string]*topic
+}
+
+// NewRegistry constructs an empty topic registry
+func NewRegistry() *Registry {
+	return &Registry{
+		topics: make(map[string]*topic),
+	}
+}
+
+func (r *Registry) topicFor(name string) *topic {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	t, ok := r.topics[name]
+	if !ok {
+		t = &topic{pending: make(map[pendingKey]chan error)}
+		r.topics[name] = t
+	}
+	return t
+}
+
+// Attach registers a connection as a subscriber of a topic, to receive
+// batches dispatched to it until Detach is called
+func (r *Registry) Attach(topicName string, conn Connection) {
+	t := r.topicFor(topicName)
+	t.mux.Lock()
+	t.conns = append(t.conns, conn)
+	t.mux.Unlock()
+	log.Infof("WS connection %s attached to topic '%s'", conn.ID(), topicName)
+}
+
+// Detach removes a connection from a topic, for example when it disconnects
+func (r *Registry) Detach(topicName string, conn Connection) {
+	t := r.topicFor(topicName)
+	t.mux.Lock()
+	for i, c := range t.conns {
+		if c.ID() == conn.ID() {
+			t.conns = append(t.conns[:i], t.conns[i+1:]...)
+			break
+		}
+	}
+	t.mux.Unlock()
+	log.Infof("WS connection %s detached from topic '%s'", conn.ID(), topicName)
+}
+
+// Dispatch sends a batch to the topic according to distributionMode, and
+// blocks until an ack/nack frame is received for (actionID, batchNumber) via
+// HandleAck, or ctx is cancelled. A nil error means the batch was ack'd.
+func (r *Registry) Dispatch(ctx context.Context, topicName, distributionMode, actionID string, batchNumber uint64, events interface{}) error {
+	t := r.topicFor(topicName)
+	key := pendingKey{actionID: actionID, batchNumber: batchNumber}
+
+	t.mux.Lock()
+	if len(t.conns) == 0 {
+		t.mux.Unlock()
+		return fmt.Errorf("no WebSocket connections attached to topic '%s'", topicName)
+	}
+	ackChan := make(chan error, 1)
+	t.pending[key] = ackChan
+	msg := &BatchMessage{Type: "batch", ActionID: actionID, BatchNumber: batchNumber, Events: events}
+	var sendErr error
+	sent := 0
+	if distributionMode == DistributionModeBroadcast {
+		for _, c := range t.conns {
+			if err := c.Send(msg); err != nil {
+				sendErr = err
+			} else {
+				sent++
+			}
+		}
+	} else {
+		c := t.conns[t.roundRobin%len(t.conns)]
+		t.roundRobin++
+		if sendErr = c.Send(msg); sendErr == nil {
+			sent++
+		}
+	}
+	t.mux.Unlock()
+
+	// In broadcast mode, a connection that failed to send may simply be gone -
+	// the batch is still live as long as at least one connection received it,
+	// so only fail fast here when every Send failed. A send failure on some
+	// connections with no failure on the ack wait is silently accepted,
+	// matching HandleAck completing on the first response received.
+	if sendErr != nil && sent == 0 {
+		t.mux.Lock()
+		delete(t.pending, key)
+		t.mux.Unlock()
+		return sendErr
+	}
+
+	select {
+	case err := <-ackChan:
+		return err
+	case <-ctx.Done():
+		t.mux.Lock()
+		delete(t.pending, key)
+		t.mux.Unlock()
+		return ctx.Err()
+	}
+}
+
+// HandleAck is called by the WS connection handler when an ack/nack frame
+// arrives from a client, to complete the pending Dispatch for that action's
+// batch. Broadcast mode completes on the first response received, matching
+// the at-least-once semantics of the block/skip error handling loop above it.
+func (r *Registry) HandleAck(topicName string, ack *AckMessage) {
+	t := r.topicFor(topicName)
+	key := pendingKey{actionID: ack.ActionID, batchNumber: ack.BatchNumber}
+	t.mux.Lock()
+	ackChan, ok := t.pending[key]
+	if ok {
+		delete(t.pending, key)
+	}
+	t.mux.Unlock()
+	if !ok {
+		log.Warnf("Received ack/nack for unknown batch %d (action=%s) on topic '%s'", ack.BatchNumber, ack.ActionID, topicName)
+		return
+	}
+	if ack.Type == "nack" {
+		err := fmt.Errorf("batch %d nacked by client: %s", ack.BatchNumber, ack.Error)
+		ackChan <- err
+	} else {
+		ackChan <- nil
+	}
+}
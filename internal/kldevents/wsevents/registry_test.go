@@ -0,0 +1,222 @@
+// Copyright 2019 Kaleido
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     http://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package wsevents
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testConn is a minimal Connection test double that records every message
+// sent to it
+type testConn struct {
+	id  string
+	msg chan *BatchMessage
+}
+
+func newTestConn(id string) *testConn {
+	return &testConn{id: id, msg: make(chan *BatchMessage, 10)}
+}
+
+func (c *testConn) ID() string { return c.id }
+
+func (c *testConn) Send(m interface{}) error {
+	c.msg <- m.(*BatchMessage)
+	return nil
+}
+
+// failingTestConn is a Connection whose Send always errors, standing in for
+// a connection that has already gone away (eg. a dead socket)
+type failingTestConn struct {
+	id string
+}
+
+func (c *failingTestConn) ID() string { return c.id }
+func (c *failingTestConn) Send(m interface{}) error {
+	return fmt.Errorf("send failed for %s", c.id)
+}
+
+// TestDispatchAttachDetach verifies a batch reaches an attached connection,
+// and that Dispatch errors immediately once it is detached
+func TestDispatchAttachDetach(t *testing.T) {
+	r := NewRegistry()
+	conn := newTestConn("conn1")
+	r.Attach("topic1", conn)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Dispatch(context.Background(), "topic1", DistributionModeLoadBalance, "action1", 1, "events")
+	}()
+
+	select {
+	case msg := <-conn.msg:
+		if msg.BatchNumber != 1 || msg.ActionID != "action1" {
+			t.Fatalf("unexpected batch message: %+v", msg)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for batch to be sent")
+	}
+	r.HandleAck("topic1", &AckMessage{Type: "ack", ActionID: "action1", BatchNumber: 1})
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error from Dispatch: %s", err)
+	}
+
+	r.Detach("topic1", conn)
+	if err := r.Dispatch(context.Background(), "topic1", DistributionModeLoadBalance, "action1", 2, "events"); err == nil {
+		t.Fatal("expected Dispatch to fail with no connections attached")
+	}
+}
+
+// TestDispatchSameBatchNumberDifferentActions verifies that two actions
+// sharing a topic - the whole point of load_balance/broadcast - don't have
+// their pending acks collide just because they both happen to be on batch 1.
+func TestDispatchSameBatchNumberDifferentActions(t *testing.T) {
+	r := NewRegistry()
+	conn := newTestConn("conn1")
+	r.Attach("topic1", conn)
+
+	done1 := make(chan error, 1)
+	done2 := make(chan error, 1)
+	go func() {
+		done1 <- r.Dispatch(context.Background(), "topic1", DistributionModeLoadBalance, "actionA", 1, "events")
+	}()
+	<-conn.msg
+	go func() {
+		done2 <- r.Dispatch(context.Background(), "topic1", DistributionModeLoadBalance, "actionB", 1, "events")
+	}()
+	<-conn.msg
+
+	r.HandleAck("topic1", &AckMessage{Type: "ack", ActionID: "actionB", BatchNumber: 1})
+	select {
+	case err := <-done2:
+		if err != nil {
+			t.Fatalf("unexpected error acking actionB: %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("actionB's Dispatch never completed - ack was misrouted")
+	}
+
+	select {
+	case err := <-done1:
+		t.Fatalf("actionA's Dispatch completed before its own ack, err=%v", err)
+	default:
+	}
+
+	r.HandleAck("topic1", &AckMessage{Type: "ack", ActionID: "actionA", BatchNumber: 1})
+	select {
+	case err := <-done1:
+		if err != nil {
+			t.Fatalf("unexpected error acking actionA: %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("actionA's Dispatch never completed")
+	}
+}
+
+// TestDispatchNack verifies a nack frame is returned as an error to the caller
+func TestDispatchNack(t *testing.T) {
+	r := NewRegistry()
+	conn := newTestConn("conn1")
+	r.Attach("topic1", conn)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Dispatch(context.Background(), "topic1", DistributionModeLoadBalance, "action1", 1, "events")
+	}()
+	<-conn.msg
+	r.HandleAck("topic1", &AckMessage{Type: "nack", ActionID: "action1", BatchNumber: 1, Error: "boom"})
+	if err := <-done; err == nil {
+		t.Fatal("expected an error from a nacked batch")
+	}
+}
+
+// TestDispatchContextCancel verifies Dispatch returns once ctx is cancelled,
+// rather than blocking forever on an ack that never comes
+func TestDispatchContextCancel(t *testing.T) {
+	r := NewRegistry()
+	conn := newTestConn("conn1")
+	r.Attach("topic1", conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Dispatch(ctx, "topic1", DistributionModeLoadBalance, "action1", 1, "events")
+	}()
+	<-conn.msg
+	cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected an error once ctx was cancelled")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Dispatch did not return after ctx cancellation")
+	}
+}
+
+// TestDispatchBroadcastPartialSendFailureWaitsForAck verifies that in
+// broadcast mode, a Send failure on one connection does not fail Dispatch
+// immediately as long as another connection received the batch - it should
+// still wait for (and honor) an ack from the connection that succeeded.
+func TestDispatchBroadcastPartialSendFailureWaitsForAck(t *testing.T) {
+	r := NewRegistry()
+	good := newTestConn("good")
+	bad := &failingTestConn{id: "bad"}
+	r.Attach("topic1", bad)
+	r.Attach("topic1", good)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Dispatch(context.Background(), "topic1", DistributionModeBroadcast, "action1", 1, "events")
+	}()
+
+	select {
+	case <-good.msg:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for the surviving connection to receive the batch")
+	}
+
+	select {
+	case err := <-done:
+		t.Fatalf("Dispatch returned before the surviving connection acked, err=%v", err)
+	default:
+	}
+
+	r.HandleAck("topic1", &AckMessage{Type: "ack", ActionID: "action1", BatchNumber: 1})
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Dispatch never completed on the surviving connection's ack")
+	}
+}
+
+// TestDispatchBroadcastAllSendsFailFastFails verifies Dispatch still fails
+// immediately, without waiting for ctx to be cancelled, when every
+// connection's Send fails in broadcast mode
+func TestDispatchBroadcastAllSendsFailFastFails(t *testing.T) {
+	r := NewRegistry()
+	r.Attach("topic1", &failingTestConn{id: "bad1"})
+	r.Attach("topic1", &failingTestConn{id: "bad2"})
+
+	err := r.Dispatch(context.Background(), "topic1", DistributionModeBroadcast, "action1", 1, "events")
+	if err == nil {
+		t.Fatal("expected an error when every broadcast connection's Send fails")
+	}
+}